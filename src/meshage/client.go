@@ -0,0 +1,21 @@
+package meshage
+
+import (
+	"encoding/gob"
+)
+
+// client represents a single connection to a neighboring node. The
+// underlying conn is either the raw transport Conn (insecure transport, see
+// NewNode) or a *secureConn established by a Noise IK handshake (see
+// NewNodeWithKeys). Either way, enc/dec read and write Messages through it.
+type client struct {
+	conn   Conn
+	enc    *gob.Encoder
+	dec    *gob.Decoder
+	hangup chan bool
+}
+
+// send gob-encodes a message and writes it to the client.
+func (c client) send(m Message) error {
+	return c.enc.Encode(m)
+}
@@ -0,0 +1,174 @@
+package meshage
+
+// This file implements the WireGuard-style cookie-reply mechanism that
+// lets a node under load defer allocating any handshake state to an
+// initiator until it proves it can receive traffic at the address it
+// claims, plus a simple token bucket that rate-limits UDP solicitations
+// per source IP. Together these bound the damage a LAN host can do by
+// flooding broadcastListener or connectionListener.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	cookieSize             = 16
+	cookieRefreshInterval  = 2 * time.Minute
+	defaultHandshakeLoadThreshold = 64
+	solicitRate                   = 20 // per second
+	solicitBurst                  = 5
+
+	// solicitLimiterIdleTTL and solicitLimiterSweepInterval bound
+	// n.solicitLimiters' size: a bucket that hasn't been touched in
+	// solicitLimiterIdleTTL is long since refilled to burst and costs
+	// nothing to recreate, so it's evicted on the next sweep. Without this,
+	// a LAN attacker varying the spoofed source IP on every solicitation
+	// would grow the map without bound.
+	solicitLimiterIdleTTL       = 10 * time.Minute
+	solicitLimiterSweepInterval = time.Minute
+)
+
+// cookieState holds the rotating MAC key Rm used to mint cookies. Rm is
+// replaced every cookieRefreshInterval so a cookie handed out can't be
+// replayed indefinitely.
+type cookieState struct {
+	mu         sync.Mutex
+	rm         [32]byte
+	lastRotate time.Time
+}
+
+func newCookieState() *cookieState {
+	cs := &cookieState{lastRotate: time.Now()}
+	io.ReadFull(rand.Reader, cs.rm[:])
+	return cs
+}
+
+func (cs *cookieState) key() [32]byte {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if time.Since(cs.lastRotate) > cookieRefreshInterval {
+		io.ReadFull(rand.Reader, cs.rm[:])
+		cs.lastRotate = time.Now()
+	}
+	return cs.rm
+}
+
+// mac computes a truncated HMAC-SHA256 over data, used for both mac1 (keyed
+// on the responder's static public key, so only someone who already knows
+// who they're talking to can produce it) and mac2 (keyed on a cookie handed
+// out by a loaded responder).
+func mac(key, data []byte) [cookieSize]byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	var out [cookieSize]byte
+	copy(out[:], h.Sum(nil))
+	return out
+}
+
+// macInput returns the bytes mac1/mac2 are computed over: everything in the
+// handshake message except the MAC fields themselves.
+func macInput(msg handshakeMessage) []byte {
+	b := make([]byte, 0, len(msg.Source)+len(msg.Ephemeral)+len(msg.Static)+len(msg.Payload))
+	b = append(b, msg.Source...)
+	b = append(b, msg.Ephemeral[:]...)
+	b = append(b, msg.Static...)
+	b = append(b, msg.Payload...)
+	return b
+}
+
+// SetHandshakeLoadThreshold overrides the default number of concurrently
+// in-progress handshakes (defaultHandshakeLoadThreshold) above which this
+// node starts replying to new initiators with a cookie instead of
+// allocating handshake state for them.
+func (n *Node) SetHandshakeLoadThreshold(threshold int32) {
+	atomic.StoreInt32(&n.handshakeLoadThreshold, threshold)
+}
+
+// underLoad reports whether the node currently has enough handshakes in
+// flight that new initiators should be asked to prove they control their
+// claimed source address before we spend any state on them.
+func (n *Node) underLoad() bool {
+	return atomic.LoadInt32(&n.pendingHandshakes) > atomic.LoadInt32(&n.handshakeLoadThreshold)
+}
+
+// tokenBucket is a simple per-source rate limiter: burst tokens refill at
+// rate tokens/second, and allow() consumes one if available.
+type tokenBucket struct {
+	mu       sync.Mutex
+	tokens   float64
+	last     time.Time
+	lastUsed time.Time
+	rate     float64
+	burst    float64
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	now := time.Now()
+	return &tokenBucket{tokens: burst, rate: rate, burst: burst, last: now, lastUsed: now}
+}
+
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.lastUsed = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// idleSince reports how long it's been since this bucket was last consulted.
+func (b *tokenBucket) idleSince() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Since(b.lastUsed)
+}
+
+// allowSolicit rate-limits UDP broadcast solicitations per source IP (20/s,
+// burst 5 by default), so a single malicious LAN host can't force
+// broadcastListener/multicastListen to spawn unbounded dial goroutines.
+func (n *Node) allowSolicit(sourceIP string) bool {
+	n.solicitLimiterLock.Lock()
+	b, ok := n.solicitLimiters[sourceIP]
+	if !ok {
+		b = newTokenBucket(solicitRate, solicitBurst)
+		n.solicitLimiters[sourceIP] = b
+	}
+	n.sweepSolicitLimitersLocked()
+	n.solicitLimiterLock.Unlock()
+	return b.allow()
+}
+
+// sweepSolicitLimitersLocked evicts buckets idle longer than
+// solicitLimiterIdleTTL, at most once per solicitLimiterSweepInterval.
+// Without this, a LAN attacker varying the spoofed source IP on every
+// solicitation would grow n.solicitLimiters without bound. Callers must
+// hold n.solicitLimiterLock.
+func (n *Node) sweepSolicitLimitersLocked() {
+	now := time.Now()
+	if now.Sub(n.solicitLimiterSwept) < solicitLimiterSweepInterval {
+		return
+	}
+	n.solicitLimiterSwept = now
+
+	for ip, b := range n.solicitLimiters {
+		if b.idleSince() > solicitLimiterIdleTTL {
+			delete(n.solicitLimiters, ip)
+		}
+	}
+}
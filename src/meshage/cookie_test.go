@@ -0,0 +1,47 @@
+package meshage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestAllowSolicitEvictsIdleLimiters demonstrates the bug chunk0-4 was
+// revised to close: n.solicitLimiters never evicted entries, so a LAN
+// attacker varying the spoofed source IP on every UDP solicitation could
+// grow the map without bound. Force a sweep by backdating
+// solicitLimiterSwept and each bucket's lastUsed, then confirm idle entries
+// are evicted while a recently-used one survives.
+func TestAllowSolicitEvictsIdleLimiters(t *testing.T) {
+	n := newNode("source", 0)
+
+	const idleCount = 100
+	for i := 0; i < idleCount; i++ {
+		n.allowSolicit(fmt.Sprintf("10.0.0.%d", i))
+	}
+	n.allowSolicit("10.0.0.live")
+
+	n.solicitLimiterLock.Lock()
+	for ip, b := range n.solicitLimiters {
+		if ip == "10.0.0.live" {
+			continue
+		}
+		b.mu.Lock()
+		b.lastUsed = time.Now().Add(-2 * solicitLimiterIdleTTL)
+		b.mu.Unlock()
+	}
+	// let the next allowSolicit call's opportunistic sweep actually run
+	n.solicitLimiterSwept = time.Now().Add(-2 * solicitLimiterSweepInterval)
+	n.solicitLimiterLock.Unlock()
+
+	n.allowSolicit("10.0.0.live")
+
+	n.solicitLimiterLock.Lock()
+	defer n.solicitLimiterLock.Unlock()
+	if len(n.solicitLimiters) != 1 {
+		t.Fatalf("solicitLimiters has %d entries after sweep, want 1 (idle entries not evicted)", len(n.solicitLimiters))
+	}
+	if _, ok := n.solicitLimiters["10.0.0.live"]; !ok {
+		t.Fatal("sweep evicted the recently-used limiter along with the idle ones")
+	}
+}
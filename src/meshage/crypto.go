@@ -0,0 +1,538 @@
+package meshage
+
+// This file implements the cryptographic handshake and transport encryption
+// used to authenticate meshage peers and protect messages in flight. The
+// handshake follows the Noise_IK pattern (the same pattern WireGuard uses
+// for its initial handshake): the initiator already knows the responder's
+// long term static public key, so the first message can be fully encrypted
+// and mutually authenticated in a single round trip.
+//
+// Wire format summary:
+//
+//	-> e, es, s, ss   (initiator)
+//	<- e, ee, se      (responder)
+//
+// After the handshake completes both sides derive independent sending and
+// receiving keys via HKDF over the accumulated transcript hash, and every
+// subsequent gob-encoded Message is wrapped in a ChaCha20-Poly1305 sealed,
+// length-prefixed frame with a strictly monotonic nonce.
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// gobEncode/gobDecode send a single handshakeMessage over the raw (not yet
+// encrypted) connection during the handshake itself.
+func gobEncode(conn Conn, v interface{}) error {
+	return gob.NewEncoder(conn).Encode(v)
+}
+
+func gobDecode(conn Conn, v interface{}) error {
+	return gob.NewDecoder(conn).Decode(v)
+}
+
+const (
+	keySize   = 32
+	macSize   = 16
+	nonceSize = 12
+)
+
+// PrivateKey is a Curve25519 scalar used as a node's long-term static identity.
+type PrivateKey [keySize]byte
+
+// PublicKey is a Curve25519 point derived from a PrivateKey.
+type PublicKey [keySize]byte
+
+// GenerateKeypair creates a new random static keypair suitable for use with
+// NewNodeWithKeys.
+func GenerateKeypair() (PrivateKey, PublicKey, error) {
+	var priv PrivateKey
+	if _, err := io.ReadFull(rand.Reader, priv[:]); err != nil {
+		return PrivateKey{}, PublicKey{}, err
+	}
+	return priv, priv.PublicKey(), nil
+}
+
+// PublicKey returns the public key corresponding to priv.
+func (priv PrivateKey) PublicKey() PublicKey {
+	var pub PublicKey
+	curve25519.ScalarBaseMult((*[keySize]byte)(&pub), (*[keySize]byte)(&priv))
+	return pub
+}
+
+// LoadPrivateKey reads a raw 32 byte static key from disk. Nodes typically
+// generate a key once with GenerateKeypair and persist it for reuse across
+// restarts, since peers authenticate by public key.
+func LoadPrivateKey(path string) (PrivateKey, error) {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return PrivateKey{}, err
+	}
+	if len(d) != keySize {
+		return PrivateKey{}, errors.New("meshage: invalid private key length")
+	}
+	var priv PrivateKey
+	copy(priv[:], d)
+	return priv, nil
+}
+
+// dh performs a Curve25519 scalar multiplication of priv with pub.
+func dh(priv PrivateKey, pub PublicKey) ([keySize]byte, error) {
+	var shared [keySize]byte
+	curve25519.ScalarMult(&shared, (*[keySize]byte)(&priv), (*[keySize]byte)(&pub))
+	// an all-zero result means the peer supplied a degenerate/low-order point
+	var zero [keySize]byte
+	if shared == zero {
+		return shared, errors.New("meshage: invalid DH result")
+	}
+	return shared, nil
+}
+
+// handshakeState tracks the running Noise symmetric state (chaining key and
+// transcript hash) across the steps of an IK handshake.
+type handshakeState struct {
+	ck [keySize]byte // chaining key
+	h  [keySize]byte // transcript hash
+}
+
+func newHandshakeState() *handshakeState {
+	hs := &handshakeState{}
+	// protocol name used as the initial chaining key/hash, per Noise conventions
+	name := "Noise_IK_25519_ChaChaPoly_SHA256"
+	var nameBytes [keySize]byte
+	copy(nameBytes[:], name)
+	hs.ck = sha256.Sum256([]byte(name))
+	hs.h = sha256.Sum256(append(hs.ck[:], nameBytes[:]...))
+	return hs
+}
+
+func (hs *handshakeState) mixHash(data []byte) {
+	h := sha256.Sum256(append(hs.h[:], data...))
+	hs.h = h
+}
+
+func (hs *handshakeState) mixKey(input []byte) (sendKey, recvKey [keySize]byte) {
+	r := hkdf.New(sha256.New, input, hs.ck[:], nil)
+	io.ReadFull(r, hs.ck[:])
+	io.ReadFull(r, sendKey[:])
+	io.ReadFull(r, recvKey[:])
+	return
+}
+
+// nonce is a strictly monotonically increasing per-direction counter used as
+// the ChaCha20-Poly1305 nonce. Re-use of a nonce under the same key would be
+// catastrophic, so sends and receives each own an independent counter and a
+// receive never accepts a counter it has already seen or skipped backwards.
+type nonce struct {
+	mu      sync.Mutex
+	counter uint64
+}
+
+func (n *nonce) next() []byte {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	b := make([]byte, nonceSize)
+	binary.LittleEndian.PutUint64(b[4:], n.counter)
+	n.counter++
+	return b
+}
+
+// maxFrameSize bounds the length prefix secureConn.Read trusts before
+// allocating a buffer for it. A gob-encoded meshage Message -- routing
+// metadata plus one Body value -- has no business approaching this; without
+// the bound, an already-authenticated peer could claim a length near
+// 0xFFFFFFFF and force a ~4GiB allocation per frame.
+const maxFrameSize = 16 * 1024 * 1024
+
+// secureConn wraps a Conn with an established pair of ChaCha20-Poly1305
+// transport keys and performs length-prefixed authenticated framing. It
+// implements Conn itself, so it plugs back into gob's Encoder/Decoder (and
+// anywhere else a Conn is expected) transparently.
+type secureConn struct {
+	conn Conn
+
+	send    sendCipher
+	recv    recvCipher
+	sendCtr nonce
+	recvCtr nonce
+	readBuf []byte
+}
+
+type sendCipher interface {
+	Seal(dst, nonce, plaintext, additionalData []byte) []byte
+}
+
+type recvCipher interface {
+	Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error)
+}
+
+func newSecureConn(conn Conn, sendKey, recvKey [keySize]byte) (*secureConn, error) {
+	send, err := chacha20poly1305.New(sendKey[:])
+	if err != nil {
+		return nil, err
+	}
+	recv, err := chacha20poly1305.New(recvKey[:])
+	if err != nil {
+		return nil, err
+	}
+	return &secureConn{conn: conn, send: send, recv: recv}, nil
+}
+
+func (s *secureConn) Write(p []byte) (int, error) {
+	sealed := s.send.Seal(nil, s.sendCtr.next(), p, nil)
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(sealed)))
+	if _, err := s.conn.Write(length[:]); err != nil {
+		return 0, err
+	}
+	if _, err := s.conn.Write(sealed); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *secureConn) Read(p []byte) (int, error) {
+	for len(s.readBuf) == 0 {
+		var length [4]byte
+		if _, err := io.ReadFull(s.conn, length[:]); err != nil {
+			return 0, err
+		}
+		n := binary.BigEndian.Uint32(length[:])
+		if n > maxFrameSize {
+			return 0, fmt.Errorf("meshage: incoming frame of %d bytes exceeds max frame size %d", n, maxFrameSize)
+		}
+		ciphertext := make([]byte, n)
+		if _, err := io.ReadFull(s.conn, ciphertext); err != nil {
+			return 0, err
+		}
+		plaintext, err := s.recv.Open(nil, s.recvCtr.next(), ciphertext, nil)
+		if err != nil {
+			return 0, errors.New("meshage: authentication failed on incoming frame")
+		}
+		s.readBuf = plaintext
+	}
+	n := copy(p, s.readBuf)
+	s.readBuf = s.readBuf[n:]
+	return n, nil
+}
+
+func (s *secureConn) Close() error {
+	return s.conn.Close()
+}
+
+// RemoteAddr satisfies Conn by delegating to the wrapped connection; only
+// Read/Write carry encryption.
+func (s *secureConn) RemoteAddr() net.Addr { return s.conn.RemoteAddr() }
+
+// handshakeMessage is the gob-encoded payload exchanged during the IK
+// handshake, before any transport encryption exists.
+type handshakeMessage struct {
+	Source    string
+	Ephemeral PublicKey
+	// Static carries the sender's static public key, encrypted under the
+	// running handshake key once one is available (empty for the
+	// responder's reply, which authenticates via se instead).
+	Static  []byte
+	Payload []byte // encrypted, authenticates hs.Source via AAD binding
+
+	// Mac1 authenticates the initiator knows who it's talking to (it's
+	// keyed on the responder's static public key) without requiring any
+	// responder state. Mac2 is only set on a retried first message, and
+	// proves the initiator received the cookie the responder handed out
+	// because it was under load.
+	Mac1 [cookieSize]byte
+	Mac2 [cookieSize]byte
+
+	// CookieReply, when true, means this message carries nothing but a
+	// cookie: the responder is under load and isn't allocating
+	// handshake state until the initiator retries with Mac2 set.
+	CookieReply bool
+	Cookie      [cookieSize]byte
+}
+
+// noiseIKInitiator runs the initiator side of the handshake over conn and
+// returns the responder's authenticated name along with transport keys for a
+// secureConn on success. responderStatic is the responder's static public
+// key, already known to the initiator (the "K" in IK) -- typically learned
+// out of band or via a previous trusted handshake.
+func noiseIKInitiator(conn Conn, name string, static PrivateKey, responderStatic PublicKey) (peerName string, sendKey, recvKey [keySize]byte, err error) {
+	hs := newHandshakeState()
+	hs.mixHash(responderStatic[:])
+
+	ePriv, ePub, err := GenerateKeypair()
+	if err != nil {
+		return
+	}
+	hs.mixHash(ePub[:])
+
+	es, err := dh(ePriv, responderStatic)
+	if err != nil {
+		return
+	}
+	esKey, _ := hs.mixKey(es[:])
+
+	// the static key is encrypted under the es-derived key, matching the
+	// responder's decryption of msg1.Static (see noiseIKResponder) -- the
+	// ss DH hasn't been mixed in yet at this point in real Noise_IK.
+	staticPub := static.PublicKey()
+	cipher, _ := chacha20poly1305.New(esKey[:])
+	var n1 nonce
+	encryptedStatic := cipher.Seal(nil, n1.next(), staticPub[:], hs.h[:])
+	hs.mixHash(encryptedStatic)
+
+	ss, err := dh(static, responderStatic)
+	if err != nil {
+		return
+	}
+	sendKey, recvKey = hs.mixKey(ss[:])
+
+	// bind the claimed source name into the transcript so it cannot be
+	// stripped or substituted downstream of the handshake
+	cipher2, _ := chacha20poly1305.New(sendKey[:])
+	var n2 nonce
+	n2.counter = 1
+	payload := cipher2.Seal(nil, n2.next(), []byte(name), hs.h[:])
+	hs.mixHash(payload)
+
+	msg1 := handshakeMessage{
+		Source:    name,
+		Ephemeral: ePub,
+		Static:    encryptedStatic,
+		Payload:   payload,
+	}
+	msg1.Mac1 = mac(responderStatic[:], macInput(msg1))
+	if err = gobEncode(conn, msg1); err != nil {
+		return
+	}
+
+	var msg2 handshakeMessage
+	if err = gobDecode(conn, &msg2); err != nil {
+		return
+	}
+
+	if msg2.CookieReply {
+		// the responder is under load and wants proof we can receive
+		// at our claimed address before it spends any state on us;
+		// retry the same first message with mac2 set.
+		msg1.Mac2 = mac(msg2.Cookie[:], macInput(msg1))
+		if err = gobEncode(conn, msg1); err != nil {
+			return
+		}
+		if err = gobDecode(conn, &msg2); err != nil {
+			return
+		}
+	}
+
+	ee, err := dh(ePriv, msg2.Ephemeral)
+	if err != nil {
+		return
+	}
+	hs.mixKey(ee[:])
+
+	se, err := dh(static, msg2.Ephemeral)
+	if err != nil {
+		return
+	}
+	sendKey, recvKey = hs.mixKey(se[:])
+
+	recvCipher, _ := chacha20poly1305.New(recvKey[:])
+	var rn nonce
+	claimedName, err := recvCipher.Open(nil, rn.next(), msg2.Payload, hs.h[:])
+	if err != nil {
+		err = errors.New("meshage: handshake authentication failed")
+		return
+	}
+
+	// msg2.Source travels in the clear; only the encrypted payload is
+	// authenticated, so that's what downstream code must trust as the
+	// responder's name
+	if string(claimedName) != msg2.Source || strings.TrimSpace(msg2.Source) == "" {
+		err = errors.New("meshage: handshake identity binding failed")
+		return
+	}
+	peerName = msg2.Source
+
+	// initiator transport keys are mirrored relative to the responder
+	return peerName, sendKey, recvKey, nil
+}
+
+// dialSecureAddr runs the initiator side of the handshake against addr. Since
+// IK requires the initiator to know the responder's static key before
+// starting, and meshage only knows peers by address at dial time, we try
+// every statically trusted key in turn, redialing a fresh connection for
+// each candidate (a failed attempt leaves the previous connection unusable,
+// since the responder closes on any handshake failure). A wrong guess costs
+// one handshake round trip, which is acceptable for the size of mesh
+// meshage targets.
+// dialSecureAddr also returns the peer's authenticated name, decrypted from
+// the handshake transcript, so callers never need to fall back on the
+// unauthenticated mesh-layer handshake to learn who they connected to.
+func (n *Node) dialSecureAddr(addr string) (Conn, *secureConn, string, error) {
+	n.trustLock.Lock()
+	candidates := make([]PublicKey, 0, len(n.trusted))
+	for k := range n.trusted {
+		candidates = append(candidates, k)
+	}
+	n.trustLock.Unlock()
+
+	if len(candidates) == 0 {
+		return nil, nil, "", errors.New("meshage: no trusted peers configured")
+	}
+
+	var lastErr error
+	for _, candidate := range candidates {
+		conn, err := n.dialTransport(addr)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		peerName, sendKey, recvKey, err := noiseIKInitiator(conn, n.name, n.static, candidate)
+		if err != nil {
+			conn.Close()
+			lastErr = err
+			continue
+		}
+		sc, err := newSecureConn(conn, sendKey, recvKey)
+		if err != nil {
+			conn.Close()
+			lastErr = err
+			continue
+		}
+		return conn, sc, peerName, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("meshage: handshake failed against all trusted peers")
+	}
+	return nil, nil, "", lastErr
+}
+
+// noiseIKResponder runs the responder side of the handshake on behalf of n
+// and reports the authenticated peer name and static key on success, along
+// with the derived transport keys. n.trusted is consulted to reject unknown
+// static keys before any mesh state is touched, and n's cookie mechanism is
+// used to defer allocating handshake state to the initiator while n is
+// under load.
+func (n *Node) noiseIKResponder(conn Conn) (peerName string, peerStatic PublicKey, sendKey, recvKey [keySize]byte, err error) {
+	name, static := n.name, n.static
+
+	hs := newHandshakeState()
+	selfPub := static.PublicKey()
+	hs.mixHash(selfPub[:])
+
+	var msg1 handshakeMessage
+	if err = gobDecode(conn, &msg1); err != nil {
+		return
+	}
+
+	if msg1.Mac1 != mac(selfPub[:], macInput(msg1)) {
+		err = errors.New("meshage: handshake mac1 verification failed")
+		return
+	}
+
+	if n.underLoad() {
+		cookieKey := n.cookie.key()
+		tau := mac(cookieKey[:], []byte(conn.RemoteAddr().String()))
+		if err = gobEncode(conn, handshakeMessage{CookieReply: true, Cookie: tau}); err != nil {
+			return
+		}
+
+		var retry handshakeMessage
+		if err = gobDecode(conn, &retry); err != nil {
+			return
+		}
+		if retry.Mac2 != mac(tau[:], macInput(retry)) {
+			err = errors.New("meshage: handshake mac2 verification failed, dropping unproven initiator")
+			return
+		}
+		msg1 = retry
+	}
+
+	hs.mixHash(msg1.Ephemeral[:])
+
+	atomic.AddInt32(&n.pendingHandshakes, 1)
+	defer atomic.AddInt32(&n.pendingHandshakes, -1)
+
+	es, err := dh(static, msg1.Ephemeral)
+	if err != nil {
+		return
+	}
+	tmpSend, _ := hs.mixKey(es[:])
+
+	decCipher, _ := chacha20poly1305.New(tmpSend[:])
+	var n1 nonce
+	staticBytes, err := decCipher.Open(nil, n1.next(), msg1.Static, hs.h[:])
+	if err != nil {
+		err = errors.New("meshage: handshake authentication failed")
+		return
+	}
+	hs.mixHash(msg1.Static)
+	copy(peerStatic[:], staticBytes)
+
+	if !n.isTrusted(peerStatic) {
+		err = errors.New("meshage: peer static key is not trusted")
+		return
+	}
+
+	ss, err := dh(static, peerStatic)
+	if err != nil {
+		return
+	}
+	tmpSend, _ = hs.mixKey(ss[:])
+
+	payloadCipher, _ := chacha20poly1305.New(tmpSend[:])
+	var n2 nonce
+	n2.counter = 1
+	claimedName, err := payloadCipher.Open(nil, n2.next(), msg1.Payload, hs.h[:])
+	if err != nil || string(claimedName) != msg1.Source || strings.TrimSpace(msg1.Source) == "" {
+		err = errors.New("meshage: handshake identity binding failed")
+		return
+	}
+	hs.mixHash(msg1.Payload)
+	peerName = msg1.Source
+
+	ePriv, ePub, err := GenerateKeypair()
+	if err != nil {
+		return
+	}
+
+	ee, err := dh(ePriv, msg1.Ephemeral)
+	if err != nil {
+		return
+	}
+	hs.mixKey(ee[:])
+
+	se, err := dh(ePriv, peerStatic)
+	if err != nil {
+		return
+	}
+	recvKey, sendKey = hs.mixKey(se[:])
+
+	replyCipher, _ := chacha20poly1305.New(sendKey[:])
+	var rn nonce
+	reply := replyCipher.Seal(nil, rn.next(), []byte(name), hs.h[:])
+
+	msg2 := handshakeMessage{
+		Source:    name,
+		Ephemeral: ePub,
+		Payload:   reply,
+	}
+	if err = gobEncode(conn, msg2); err != nil {
+		return
+	}
+
+	return peerName, peerStatic, sendKey, recvKey, nil
+}
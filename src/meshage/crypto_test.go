@@ -0,0 +1,97 @@
+package meshage
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// TestNoiseIKHandshakeRoundTrip drives noiseIKInitiator and
+// (*Node).noiseIKResponder against each other over a net.Pipe and checks
+// that they land on the same transport keys, with each side's send key
+// equal to the other's receive key.
+func TestNoiseIKHandshakeRoundTrip(t *testing.T) {
+	initiatorPriv, initiatorPub, err := GenerateKeypair()
+	if err != nil {
+		t.Fatalf("GenerateKeypair(initiator): %v", err)
+	}
+	responderPriv, responderPub, err := GenerateKeypair()
+	if err != nil {
+		t.Fatalf("GenerateKeypair(responder): %v", err)
+	}
+
+	responder := &Node{
+		name:    "responder",
+		static:  responderPriv,
+		trusted: map[PublicKey]bool{initiatorPub: true},
+	}
+
+	initiatorConn, responderConn := net.Pipe()
+	defer initiatorConn.Close()
+	defer responderConn.Close()
+
+	type initiatorResult struct {
+		peerName         string
+		sendKey, recvKey [keySize]byte
+		err              error
+	}
+	initDone := make(chan initiatorResult, 1)
+	go func() {
+		peerName, sendKey, recvKey, err := noiseIKInitiator(initiatorConn, "initiator", initiatorPriv, responderPub)
+		initDone <- initiatorResult{peerName, sendKey, recvKey, err}
+	}()
+
+	peerName, peerStatic, respSendKey, respRecvKey, err := responder.noiseIKResponder(responderConn)
+	if err != nil {
+		t.Fatalf("noiseIKResponder: %v", err)
+	}
+	if peerName != "initiator" {
+		t.Fatalf("peerName = %q, want %q", peerName, "initiator")
+	}
+	if peerStatic != initiatorPub {
+		t.Fatalf("peerStatic = %x, want %x", peerStatic, initiatorPub)
+	}
+
+	res := <-initDone
+	if res.err != nil {
+		t.Fatalf("noiseIKInitiator: %v", res.err)
+	}
+	if res.peerName != "responder" {
+		t.Fatalf("initiator's peerName = %q, want %q", res.peerName, "responder")
+	}
+
+	if res.sendKey != respRecvKey {
+		t.Errorf("initiator send key != responder recv key")
+	}
+	if res.recvKey != respSendKey {
+		t.Errorf("initiator recv key != responder send key")
+	}
+}
+
+// TestSecureConnReadRejectsOversizedFrame demonstrates that secureConn.Read
+// bounds the length prefix it trusts before allocating a buffer for it. An
+// already-authenticated but malicious peer claiming a frame length near
+// 0xFFFFFFFF must be rejected instead of forcing a multi-gigabyte
+// allocation.
+func TestSecureConnReadRejectsOversizedFrame(t *testing.T) {
+	var key [keySize]byte
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	sc, err := newSecureConn(a, key, key)
+	if err != nil {
+		t.Fatalf("newSecureConn: %v", err)
+	}
+
+	go func() {
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], maxFrameSize+1)
+		b.Write(length[:])
+	}()
+
+	buf := make([]byte, 1)
+	if _, err := sc.Read(buf); err == nil {
+		t.Fatal("Read accepted a frame length over maxFrameSize")
+	}
+}
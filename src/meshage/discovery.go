@@ -0,0 +1,274 @@
+package meshage
+
+// This file implements multicast peer discovery, modeled on yggdrasil's
+// multicast module, as an alternative to the IPv4 limited broadcast
+// (255.255.255.255) checkDegree/broadcastListener normally use. Broadcast
+// doesn't traverse most modern network stacks -- many switches drop it,
+// containers without host networking never see it, and it simply doesn't
+// exist on IPv6-only segments -- whereas link-local multicast works on
+// both address families and across more topologies.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	log "minilog"
+	"net"
+	"time"
+)
+
+// DiscoveryMode selects how a Node finds peers to satisfy its degree.
+type DiscoveryMode int
+
+const (
+	// DiscoveryBroadcast sends IPv4 limited-broadcast solicitations, as
+	// meshage always has. This is the default.
+	DiscoveryBroadcast DiscoveryMode = iota
+	// DiscoveryMulticast joins an IPv6 (and optionally IPv4) multicast
+	// group on each configured interface and exchanges beacons.
+	DiscoveryMulticast
+	// DiscoveryOff disables automatic peer discovery entirely; peers
+	// must be added with Dial.
+	DiscoveryOff
+)
+
+const (
+	multicastGroupV6 = "ff02::114"
+	multicastGroupV4 = "239.0.0.114"
+
+	defaultBeaconInterval = 5 * time.Second
+	// defaultBeaconTTL bounds how old a beacon's timestamp may be before
+	// it's ignored, guarding against a stale or replayed beacon causing
+	// a dial to a long-gone listener.
+	defaultBeaconTTL = 30 * time.Second
+)
+
+// beacon is broadcast periodically over multicast so peers can find each
+// other without relying on hostname resolution: the sender advertises
+// exactly the address and port it is reachable at.
+type beacon struct {
+	Name              string
+	ListenAddr        string
+	ListenPort        int
+	StaticFingerprint [8]byte // truncated SHA-256 of the sender's static pubkey, 0 if running insecure
+	Timestamp         int64   // unix nanoseconds, used only to drop stale beacons
+}
+
+func init() {
+	gob.Register(beacon{})
+}
+
+// SetDiscovery switches how n finds new peers. Switching away from
+// DiscoveryMulticast stops any beaconing/listening goroutines for the
+// previous interface set; switching to DiscoveryMulticast starts them on
+// ifaces (an empty slice means all multicast-capable interfaces).
+func (n *Node) SetDiscovery(mode DiscoveryMode, ifaces []string) error {
+	n.discoveryLock.Lock()
+	defer n.discoveryLock.Unlock()
+
+	if n.discoveryCancel != nil {
+		close(n.discoveryCancel)
+		n.discoveryCancel = nil
+	}
+	n.discoveryMode = mode
+
+	if mode != DiscoveryMulticast {
+		return nil
+	}
+
+	ifs, err := multicastInterfaces(ifaces)
+	if err != nil {
+		return err
+	}
+	if len(ifs) == 0 {
+		return fmt.Errorf("meshage: no multicast-capable interfaces found")
+	}
+
+	cancel := make(chan struct{})
+	n.discoveryCancel = cancel
+	for _, ifi := range ifs {
+		go n.beaconLoop(ifi, cancel)
+		go n.multicastListen(ifi, "udp6", &net.UDPAddr{IP: net.ParseIP(multicastGroupV6), Port: PORT}, cancel)
+		go n.multicastListen(ifi, "udp4", &net.UDPAddr{IP: net.ParseIP(multicastGroupV4), Port: PORT}, cancel)
+	}
+	return nil
+}
+
+// SetBeaconInterval overrides how often multicast beacons are sent.
+func (n *Node) SetBeaconInterval(d time.Duration) {
+	n.discoveryLock.Lock()
+	defer n.discoveryLock.Unlock()
+	n.beaconInterval = d
+}
+
+// SetBeaconTTL overrides how old a received beacon may be before it's
+// ignored as stale.
+func (n *Node) SetBeaconTTL(d time.Duration) {
+	n.discoveryLock.Lock()
+	defer n.discoveryLock.Unlock()
+	n.beaconTTL = d
+}
+
+func multicastInterfaces(names []string) ([]net.Interface, error) {
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	want := make(map[string]bool, len(names))
+	for _, n := range names {
+		want[n] = true
+	}
+
+	var out []net.Interface
+	for _, ifi := range all {
+		if len(names) > 0 && !want[ifi.Name] {
+			continue
+		}
+		if ifi.Flags&net.FlagMulticast == 0 || ifi.Flags&net.FlagUp == 0 {
+			continue
+		}
+		out = append(out, ifi)
+	}
+	return out, nil
+}
+
+// beaconLoop periodically advertises this node on ifi over both multicast
+// groups until cancel is closed.
+func (n *Node) beaconLoop(ifi net.Interface, cancel chan struct{}) {
+	for {
+		n.discoveryLock.Lock()
+		interval := n.beaconInterval
+		n.discoveryLock.Unlock()
+
+		n.sendBeacon(ifi, "udp6", &net.UDPAddr{IP: net.ParseIP(multicastGroupV6), Port: PORT})
+		n.sendBeacon(ifi, "udp4", &net.UDPAddr{IP: net.ParseIP(multicastGroupV4), Port: PORT})
+
+		select {
+		case <-cancel:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (n *Node) sendBeacon(ifi net.Interface, network string, group *net.UDPAddr) {
+	conn, err := net.ListenMulticastUDP(network, &ifi, group)
+	if err != nil {
+		// interface may simply not support this address family; not
+		// an operational error worth surfacing on n.errors
+		log.Debug("beacon: %v\n", err)
+		return
+	}
+	defer conn.Close()
+
+	b := beacon{
+		Name:       n.name,
+		ListenAddr: primaryAddr(ifi),
+		ListenPort: PORT,
+		Timestamp:  time.Now().UnixNano(),
+	}
+	if !n.insecure {
+		pub := n.static.PublicKey()
+		sum := sha256.Sum256(pub[:])
+		copy(b.StaticFingerprint[:], sum[:8])
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(b); err != nil {
+		log.Errorln(err)
+		return
+	}
+	if _, err := conn.WriteTo(buf.Bytes(), group); err != nil {
+		log.Debug("beacon write: %v\n", err)
+	}
+}
+
+// multicastListen joins group on ifi and dials whoever beacons on it.
+//
+// Unlike the Noise-authenticated connections a successful dial produces,
+// the beacon itself arrives over plain unauthenticated UDP -- exactly like
+// the IPv4 broadcast solicitations broadcastListener reads -- so it gets
+// the same two defenses: allowSolicit rate-limits how many beacons a single
+// source IP can trigger a dial for, and, on a secure node, the beacon's
+// StaticFingerprint must match a trusted peer before it's trusted enough to
+// dial at all. An insecure node has no trusted set to check against, so it
+// dials on any beacon just as it accepts any broadcast solicitation.
+func (n *Node) multicastListen(ifi net.Interface, network string, group *net.UDPAddr, cancel chan struct{}) {
+	conn, err := net.ListenMulticastUDP(network, &ifi, group)
+	if err != nil {
+		log.Debug("multicast listen: %v\n", err)
+		return
+	}
+	defer conn.Close()
+
+	go func() {
+		<-cancel
+		conn.Close()
+	}()
+
+	for {
+		d := make([]byte, 1024)
+		read, addr, err := conn.ReadFromUDP(d)
+		if err != nil {
+			// either cancelled (conn closed above) or a transient
+			// read error; either way, stop this listener
+			return
+		}
+
+		if !n.allowSolicit(addr.IP.String()) {
+			log.Debug("rate limiting beacon from %v\n", addr.IP)
+			continue
+		}
+
+		var b beacon
+		if err := gob.NewDecoder(bytes.NewReader(d[:read])).Decode(&b); err != nil {
+			log.Debug("malformed beacon: %v\n", err)
+			continue
+		}
+
+		if b.Name == n.name {
+			continue
+		}
+
+		if !n.insecure && !n.isTrustedFingerprint(b.StaticFingerprint) {
+			log.Debug("dropping beacon from %v: untrusted static fingerprint\n", b.Name)
+			continue
+		}
+
+		n.discoveryLock.Lock()
+		ttl := n.beaconTTL
+		n.discoveryLock.Unlock()
+		if ttl > 0 && time.Since(time.Unix(0, b.Timestamp)) > ttl {
+			log.Debug("dropping stale beacon from %v\n", b.Name)
+			continue
+		}
+
+		log.Debug("got beacon from %v at %v:%v\n", b.Name, b.ListenAddr, b.ListenPort)
+		go n.dialAddr(fmt.Sprintf("%s:%d", b.ListenAddr, b.ListenPort), true)
+	}
+}
+
+// primaryAddr returns the first usable unicast address on ifi, which is
+// what we advertise in our beacon as our reachable listen address.
+func primaryAddr(ifi net.Interface) string {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return ""
+	}
+	for _, a := range addrs {
+		var ip net.IP
+		switch v := a.(type) {
+		case *net.IPNet:
+			ip = v.IP
+		case *net.IPAddr:
+			ip = v.IP
+		}
+		if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+			continue
+		}
+		return ip.String()
+	}
+	return ""
+}
@@ -0,0 +1,42 @@
+package meshage
+
+import (
+	"crypto/sha256"
+	"testing"
+)
+
+// TestIsTrustedFingerprint demonstrates the check multicastListen relies on
+// to reject beacons (see discovery.go): a trusted peer's own fingerprint
+// matches, an untrusted key's doesn't, and an insecure node's zero-value
+// fingerprint -- since sendBeacon never populates StaticFingerprint when
+// n.insecure -- isn't accidentally treated as trusted.
+func TestIsTrustedFingerprint(t *testing.T) {
+	_, trustedPub, err := GenerateKeypair()
+	if err != nil {
+		t.Fatalf("GenerateKeypair(trusted): %v", err)
+	}
+	_, untrustedPub, err := GenerateKeypair()
+	if err != nil {
+		t.Fatalf("GenerateKeypair(untrusted): %v", err)
+	}
+
+	n := &Node{trusted: map[PublicKey]bool{trustedPub: true}}
+
+	var trustedFP [8]byte
+	sum := sha256.Sum256(trustedPub[:])
+	copy(trustedFP[:], sum[:8])
+	if !n.isTrustedFingerprint(trustedFP) {
+		t.Error("trusted peer's own fingerprint was rejected")
+	}
+
+	var untrustedFP [8]byte
+	sum = sha256.Sum256(untrustedPub[:])
+	copy(untrustedFP[:], sum[:8])
+	if n.isTrustedFingerprint(untrustedFP) {
+		t.Error("untrusted key's fingerprint was accepted")
+	}
+
+	if n.isTrustedFingerprint([8]byte{}) {
+		t.Error("zero-value fingerprint (an insecure beacon's) was accepted as trusted")
+	}
+}
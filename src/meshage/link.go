@@ -0,0 +1,263 @@
+package meshage
+
+// This file implements inter-mesh peering: bridging two otherwise separate
+// meshage networks through a single process that holds a membership in
+// each one, modeled on a border router joining two routing domains. A Link
+// keeps the two meshes administratively separate -- each side only ever
+// learns that a single bridge node exists, never the other side's real
+// topology -- and only the Set recipients and broadcasts the operator
+// explicitly allows cross between them.
+
+import (
+	"encoding/gob"
+	"fmt"
+	log "minilog"
+	"net"
+	"sync"
+)
+
+func init() {
+	gob.Register(&ackErr{})
+}
+
+// ackErr adapts an arbitrary error into one forwardSet's ack.Err can actually
+// survive gob-encoding as: gob only encodes a type's exported fields by
+// reflection, and fmt.Errorf's *errors.errorString/*fmt.wrapError have none,
+// while *SetError's only field, Failed, holds errors of exactly those kinds,
+// so putting them in ack.Err directly silently fails to encode at all. wrapAckErr is the only place that should construct one.
+type ackErr struct {
+	Msg string
+}
+
+func (e *ackErr) Error() string { return e.Msg }
+
+// wrapAckErr adapts err, which may be nil, into ack.Err.
+func wrapAckErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ackErr{Msg: err.Error()}
+}
+
+// LinkOptions controls what a Link forwards across the bridge it
+// maintains between two meshes.
+type LinkOptions struct {
+	// AllowBroadcast lets broadcast messages cross the link from near to
+	// far. Broadcasts are dropped at the bridge by default, since a
+	// storm on one mesh shouldn't flood an administratively separate one.
+	AllowBroadcast bool
+
+	// AllowedRecipients reports whether a Set addressed to name may cross
+	// the link into the far mesh. A nil func allows every recipient
+	// through.
+	AllowedRecipients func(name string) bool
+
+	// Degree is the degree the far-side membership advertises on the
+	// remote mesh, independent of the local Node's own degree.
+	Degree uint
+}
+
+func (o LinkOptions) allows(name string) bool {
+	return o.AllowedRecipients == nil || o.AllowedRecipients(name)
+}
+
+var (
+	meshIDLock sync.Mutex
+	meshIDNext uint64
+)
+
+// nextMeshID hands out process-unique mesh ids for Links, used to name the
+// synthetic bridge identity each Link presents to the near mesh.
+func nextMeshID() string {
+	meshIDLock.Lock()
+	defer meshIDLock.Unlock()
+	meshIDNext++
+	return fmt.Sprintf("link-%d", meshIDNext)
+}
+
+// A Link bridges a local Node's mesh ("near") to a second mesh reachable at
+// a remote address ("far"). It holds a full Node membership in the far
+// mesh under a synthetic bridge name, and joins near's mesh as an ordinary
+// client under that same name over an in-process net.Pipe -- so near's
+// existing Set/Broadcast routing, Mesh() and Hangup already work against
+// the bridge with no changes of their own. Near's mesh only ever sees one
+// synthetic edge to the bridge, never far's topology, because the union
+// announcement a Link makes on joining carries nothing but that one edge.
+type Link struct {
+	opts LinkOptions
+
+	near       *Node
+	far        *Node
+	bridgeName string
+	meshID     string
+
+	conn      net.Conn // this side of the near<->bridge net.Pipe
+	nearEnc   *gob.Encoder
+	nearWrite sync.Mutex
+}
+
+// Peer bridges n's mesh to the mesh reachable at remoteAddr and returns the
+// Link maintaining that bridge.
+func (n *Node) Peer(remoteAddr string, opts LinkOptions) (*Link, error) {
+	meshID := nextMeshID()
+	bridgeName := fmt.Sprintf("%s-bridge-%s", n.name, meshID)
+
+	f := newNode(bridgeName, opts.Degree)
+	f.meshID = meshID
+	f.insecure = n.insecure
+	f.static = n.static
+	f.trusted = n.trusted
+	go f.connectionListener()
+	go f.messageHandler()
+	go f.checkDegree()
+
+	if err := f.Dial(remoteAddr); err != nil {
+		return nil, err
+	}
+
+	l := &Link{
+		opts:       opts,
+		near:       n,
+		far:        &f,
+		bridgeName: bridgeName,
+		meshID:     meshID,
+	}
+
+	conn, bridgeConn := net.Pipe()
+	go n.handleConnection(conn, true)
+	if err := l.joinNear(bridgeConn); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// joinNear plays the initiator side of near's ordinary connection protocol
+// over bridgeConn (the bridge's end of the net.Pipe handed to near's
+// handleConnection), so near adds the Link as a genuine client named
+// bridgeName. It then announces a single synthetic edge (near <-> bridge)
+// as a normal UNION broadcast, which near's own messageHandler merges and
+// re-floods exactly as it would for any other new neighbor -- without this
+// Link ever needing to touch near's mesh, routes or clients directly.
+func (l *Link) joinNear(bridgeConn net.Conn) error {
+	enc := gob.NewEncoder(bridgeConn)
+	dec := gob.NewDecoder(bridgeConn)
+
+	var hs Message
+	if err := dec.Decode(&hs); err != nil {
+		return err
+	}
+
+	resp := Message{
+		MessageType:  SET,
+		Source:       l.bridgeName,
+		CurrentRoute: []string{l.bridgeName},
+		Command:      ACK,
+	}
+	if err := enc.Encode(resp); err != nil {
+		return err
+	}
+
+	announce := Message{
+		MessageType:  BROADCAST,
+		Source:       l.bridgeName,
+		CurrentRoute: []string{l.bridgeName},
+		ID:           1, // the bridge identity's first (and only) broadcast
+		Command:      UNION,
+		Body: map[string][]string{
+			l.near.name:  {l.bridgeName},
+			l.bridgeName: {l.near.name},
+		},
+		MeshID: l.meshID,
+	}
+	if err := enc.Encode(announce); err != nil {
+		return err
+	}
+
+	l.conn = bridgeConn
+	l.nearEnc = enc
+	go l.readNear(dec)
+	return nil
+}
+
+// readNear reads messages near routes to bridgeName and forwards the ones
+// opts allows into the far mesh. Control traffic (UNION/INTERSECTION) is
+// near's own topology bookkeeping and never crosses the bridge -- only
+// Command == MESSAGE is eligible.
+func (l *Link) readNear(dec *gob.Decoder) {
+	for {
+		var m Message
+		if err := dec.Decode(&m); err != nil {
+			return
+		}
+		if m.Command != MESSAGE {
+			continue
+		}
+
+		switch m.MessageType {
+		case BROADCAST:
+			if l.opts.AllowBroadcast {
+				l.far.Broadcast(m.Body)
+			}
+		case SET:
+			for _, recipient := range m.Recipients {
+				go l.forwardSet(m, recipient)
+			}
+		}
+	}
+}
+
+// forwardSet forwards one recipient of a Set message into the far mesh if
+// opts.AllowedRecipients allows it, then relays the resulting ack (or a
+// rejection, if it doesn't) back to near so the original Set caller's
+// setSend sees a normal per-recipient ack rather than timing out.
+func (l *Link) forwardSet(m Message, recipient string) {
+	var sendErr error
+	if l.opts.allows(recipient) {
+		sendErr = l.far.Set([]string{recipient}, m.Body)
+	} else {
+		sendErr = fmt.Errorf("meshage: recipient %v not allowed across link", recipient)
+	}
+
+	a := Message{
+		MessageType:  SET,
+		Recipients:   []string{m.Source}, // route back to the original Set caller, same as any other Set message
+		Source:       l.bridgeName,
+		CurrentRoute: []string{l.bridgeName},
+		ID:           l.far.setID(), // must be non-zero and increasing: replayFilter.accept rejects ID 0 outright
+		Command:      ACK,
+		Body: ack{
+			Source:    m.Source,
+			SetID:     m.ID,
+			Recipient: recipient,
+			Err:       wrapAckErr(sendErr),
+		},
+	}
+
+	l.nearWrite.Lock()
+	defer l.nearWrite.Unlock()
+	if err := l.nearEnc.Encode(a); err != nil {
+		log.Debug("link: writing ack to near: %v\n", err)
+	}
+}
+
+// Messages returns messages the far mesh has addressed directly to this
+// Link's bridge identity. Unlike the near-to-far direction, where a Set's
+// Recipients already name who on the far side it's for, the far mesh only
+// ever knows the bridge's synthetic name -- never any real name on near's
+// side -- so a Link can't guess how to re-deliver these into near's mesh.
+// Callers that want far traffic to continue on into near should read this
+// channel and call near's own Set or Broadcast themselves.
+func (l *Link) Messages() <-chan Message {
+	return l.far.receive
+}
+
+// Close disconnects the bridge from near, which announces the departure to
+// the rest of near's mesh exactly like any other neighbor hanging up, and
+// stops forwarding near-to-far traffic. The far-side membership is left
+// running; meshage has no general mechanism for shutting a Node down.
+func (l *Link) Close() error {
+	err := l.near.Hangup(l.bridgeName)
+	l.conn.Close()
+	return err
+}
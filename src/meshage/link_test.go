@@ -0,0 +1,59 @@
+package meshage
+
+import (
+	"encoding/gob"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestForwardSetAckIsAccepted demonstrates the bug chunk0-6 was filed to
+// close: forwardSet's relayed ack Message never set ID, so it was
+// gob-encoded with the zero value, which replayFilter.accept unconditionally
+// rejects (see replay.go). Every Set() whose recipient lived across a Link
+// timed out even when the far-side send actually succeeded. Feed exactly the
+// Message forwardSet produces through near's ordinary messageHandler and
+// confirm the ack it carries reaches a waiting setSend call instead of being
+// silently dropped.
+func TestForwardSetAckIsAccepted(t *testing.T) {
+	near := newNode("near", 0)
+	go near.messageHandler()
+
+	far := newNode("near-bridge-link-1", 0)
+
+	conn, bridgeConn := net.Pipe()
+	defer conn.Close()
+	defer bridgeConn.Close()
+
+	l := &Link{
+		near:       &near,
+		far:        &far,
+		bridgeName: far.name,
+		nearEnc:    gob.NewEncoder(bridgeConn),
+	}
+
+	// register exactly the ackWaiter a real setSend call on near would have
+	// set up for this (source, setID, recipient)
+	waitKey := ackKey{source: "near", setID: 7, recipient: "far-peer"}
+	ch := make(chan error, 1)
+	near.ackLock.Lock()
+	near.ackWaiters[waitKey] = ch
+	near.ackLock.Unlock()
+
+	go func() {
+		dec := gob.NewDecoder(conn)
+		var m Message
+		if err := dec.Decode(&m); err != nil {
+			return
+		}
+		near.messagePump <- inboundMessage{Message: m, from: far.name}
+	}()
+
+	l.forwardSet(Message{Source: "near", ID: 7, Recipients: []string{"far-peer"}}, "far-peer")
+
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatal("ack forwarded across the link was never delivered to the waiting setSend call")
+	}
+}
@@ -10,16 +10,19 @@
 // receiving messages of any type. This also means that any node is capable of 
 // issuing control messages that affect the topology of the mesh.
 // 
-// Meshage is secure and resilient - All messages are signed and encrypted by 
-// the sender to guarantee authenticity and integrity. Nodes on the network 
-// store public keys of trusted agents, who may send messages signed and 
-// encrypted with a corresponding private key. This is generally done by the 
-// end user. Compromised nodes on the mesh that attempt denial of service 
-// through discarding messages routed through them are automatically removed 
-// from the network by neighbor nodes.  
+// Meshage is secure and resilient - Nodes created with NewNodeWithKeys
+// authenticate every peer with a Noise IK handshake and encrypt the full
+// session with ChaCha20-Poly1305; only peers whose static public key is in
+// the node's trusted set are ever added to the mesh. NewNode remains
+// available as an insecure, unauthenticated transport for backward
+// compatibility. Compromised nodes on the mesh that attempt denial of
+// service through discarding messages routed through them are automatically
+// removed from the network by neighbor nodes.
 package meshage
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/gob"
 	"fmt"
 	"io"
@@ -52,14 +55,15 @@ const (
 // Node object with a non-zero degree will cause it to begin broadcasting for 
 // connections automatically.
 type Node struct {
-	name               string              // node name. Must be unique on a network.
-	degree             uint                // degree for this node, set to 0 to force node to not broadcast
-	mesh               map[string][]string // adjacency list for the known topology for this node
-	setSequences       map[string]uint64   // set sequence IDs for each node, including this node
-	broadcastSequences map[string]uint64   // broadcast sequence IDs for each node, including this node
-	routes             map[string]string   // one-hop routes for every node on the network, including this node
+	name               string                    // node name. Must be unique on a network.
+	degree             uint                      // degree for this node, set to 0 to force node to not broadcast
+	mesh               map[string][]string       // adjacency list for the known topology for this node
+	setSequences       map[string]uint64         // set sequence IDs generated by this node
+	broadcastSequences map[string]uint64         // broadcast sequence IDs generated by this node
+	setReplay          map[string]*replayFilter  // sliding-window replay filters for incoming set messages, keyed by source
+	broadcastReplay    map[string]*replayFilter  // sliding-window replay filters for incoming broadcast messages, keyed by source
+	routes             map[string]string         // one-hop routes for every node on the network, including this node
 	receive            chan Message        // channel of incoming messages. A program will read this channel for incoming messages to this node
-	ackChan		chan ack
 
 	clients      map[string]client // list of connections to this node
 	clientLock   sync.Mutex
@@ -67,15 +71,102 @@ type Node struct {
 	meshLock     sync.Mutex
 	degreeLock   sync.Mutex
 	setLock	     sync.Mutex
-	messagePump  chan Message
+	messagePump  chan inboundMessage
 
 	errors chan error
+
+	// insecure, when true, skips the Noise handshake entirely and speaks
+	// plain gob over TCP as meshage always has. Only NewNode sets this;
+	// NewNodeWithKeys always authenticates and encrypts peers.
+	insecure bool
+	static   PrivateKey
+	trusted  map[PublicKey]bool
+	trustLock sync.Mutex
+
+	// cookie-reply DoS mitigation (see cookie.go): pendingHandshakes
+	// counts in-flight responder handshakes, and once it exceeds
+	// handshakeLoadThreshold new initiators must prove they can receive
+	// at their claimed address before any state is allocated for them.
+	cookie                 *cookieState
+	pendingHandshakes       int32
+	handshakeLoadThreshold  int32
+	solicitLimiters         map[string]*tokenBucket
+	solicitLimiterLock      sync.Mutex
+	solicitLimiterSwept     time.Time
+
+	// sendTimeout bounds how long Set waits for any one recipient's ack
+	// before giving up on it. Guarded by setLock; override with
+	// SetSendTimeout.
+	sendTimeout time.Duration
+	ackWaiters  map[ackKey]chan error
+	ackLock     sync.Mutex
+
+	// discovery controls how checkDegree finds peers; see discovery.go.
+	// discoveryCancel, when non-nil, stops the multicast beacon/listen
+	// goroutines for the previously configured interface set.
+	discoveryMode   DiscoveryMode
+	discoveryCancel chan struct{}
+	discoveryLock   sync.Mutex
+	beaconInterval  time.Duration
+	beaconTTL       time.Duration
+
+	// meshID identifies which mesh this Node is the home member of. It is
+	// always empty for an ordinary Node; Peer sets it on a Link's far-side
+	// membership (see link.go) so messages that cross the bridge carry a
+	// non-empty Message.MeshID, which receivers fold into their replay
+	// filter keys (see replayMaxAdvance). The sequence counters themselves
+	// are never shared, since far is a wholly distinct Node with its own
+	// setSequences/broadcastSequences.
+	meshID string
+
+	// transports holds every registered Transport, keyed by the scheme
+	// its dial addresses use; see transport.go. newNode always registers
+	// the original TCP+gob transport under "tcp", so existing bare
+	// "host:port" addresses keep resolving exactly as they always have.
+	transports     map[string]Transport
+	transportsLock sync.Mutex
+}
+
+// DefaultSendTimeout is how long Set waits for a recipient's ack before
+// reporting a timeout for it, unless overridden with SetSendTimeout.
+const DefaultSendTimeout = 30 * time.Second
+
+// ackKey identifies a single recipient's outstanding ack for one particular
+// Set call, so that acks for concurrent calls (or for a Set call racing a
+// relayed message at an intermediate hop) never land on each other.
+type ackKey struct {
+	source    string
+	setID     uint64
+	recipient string
 }
 
-// an ack struct contains a responding node and error message. A nil error means ACK. 
+// an ack struct contains a responding node and error message. A nil error means ACK.
 type ack struct {
+	Source    string // name of the node that originated the Set call
+	SetID     uint64 // sequence ID of the set message being acked
 	Recipient string
-	Err error
+	Err       error
+}
+
+// SetError reports, per recipient, why a Set call didn't fully succeed. A
+// recipient present in Failed never acked: the error is either a routing
+// failure, an explicit NACK relayed back by a downstream node, or a timeout.
+type SetError struct {
+	Failed map[string]error
+}
+
+func (e *SetError) Error() string {
+	recipients := make([]string, 0, len(e.Failed))
+	for v := range e.Failed {
+		recipients = append(recipients, v)
+	}
+	sort.Strings(recipients)
+
+	parts := make([]string, len(recipients))
+	for i, v := range recipients {
+		parts[i] = fmt.Sprintf("%v: %v", v, e.Failed[v])
+	}
+	return fmt.Sprintf("meshage: Set failed for %d recipient(s): %v", len(e.Failed), strings.Join(parts, "; "))
 }
 
 // A Message is the payload for all message passing, and contains the user 
@@ -88,6 +179,22 @@ type Message struct {
 	ID           uint64      // sequence id
 	Command      int         // union, intersection, message, ack
 	Body         interface{} // message body
+
+	// MeshID identifies which mesh this message originated on. It is
+	// empty for ordinary same-mesh traffic and is only ever set by a Link
+	// bridging two meshes (see link.go). messageHandler uses it, together
+	// with Source, to pick the replay filter for the message; otherwise it
+	// is passed through unexamined.
+	MeshID string
+}
+
+// inboundMessage pairs a Message arriving on n.messagePump with the name of
+// the client it arrived from, so messageHandler can tell a message actually
+// originating at that immediate, authenticated neighbor (see
+// replayMaxAdvance) apart from one merely relayed through it.
+type inboundMessage struct {
+	Message
+	from string
 }
 
 func init() {
@@ -95,30 +202,166 @@ func init() {
 	gob.Register(ack{})
 }
 
-// NewNode returns a new node and receiver channel with a given name and 
-// degree. If degree is non-zero, the node will automatically begin 
+// NewNode returns a new node and receiver channel with a given name and
+// degree. If degree is non-zero, the node will automatically begin
 // broadcasting for connections.
-func NewNode(name string, degree uint) (Node, chan Message, chan error) {
+//
+// NewNode speaks the original, insecure meshage transport: plain gob over
+// TCP with no authentication or encryption. It is kept for backward
+// compatibility with callers that can't yet provision static keypairs; new
+// deployments should prefer NewNodeWithKeys. opts can register additional
+// Transports (see WithTransport); by default a Node only has the original
+// TCP+gob transport.
+func NewNode(name string, degree uint, opts ...NodeOption) (Node, chan Message, chan error) {
+	n := newNode(name, degree)
+	n.insecure = true
+	for _, opt := range opts {
+		opt(&n)
+	}
+	go n.connectionListener()
+	go n.broadcastListener()
+	go n.messageHandler()
+	go n.checkDegree()
+	return n, n.receive, n.errors
+}
+
+// NewNodeWithKeys returns a new node, as NewNode does, but requires every
+// peer to complete a Noise IK handshake using static as this node's
+// long-term identity. Only peers whose static public key appears in trusted
+// are accepted; everyone else is disconnected before any mesh state (routes,
+// client list, sequence numbers) is touched. opts can register additional
+// Transports (see WithTransport).
+func NewNodeWithKeys(name string, degree uint, static PrivateKey, trusted []PublicKey, opts ...NodeOption) (Node, chan Message, chan error) {
+	n := newNode(name, degree)
+	n.static = static
+	n.trusted = make(map[PublicKey]bool)
+	for _, k := range trusted {
+		n.trusted[k] = true
+	}
+	for _, opt := range opts {
+		opt(&n)
+	}
+	go n.connectionListener()
+	go n.broadcastListener()
+	go n.messageHandler()
+	go n.checkDegree()
+	return n, n.receive, n.errors
+}
+
+func newNode(name string, degree uint) Node {
 	n := Node{
 		name:               name,
 		degree:             degree,
 		mesh:               make(map[string][]string),
 		setSequences:       make(map[string]uint64),
 		broadcastSequences: make(map[string]uint64),
+		setReplay:          make(map[string]*replayFilter),
+		broadcastReplay:    make(map[string]*replayFilter),
 		routes:             make(map[string]string),
 		receive:            make(chan Message, RECEIVE_BUFFER),
 		clients:            make(map[string]client),
-		messagePump:        make(chan Message, RECEIVE_BUFFER),
+		messagePump:        make(chan inboundMessage, RECEIVE_BUFFER),
 		errors:             make(chan error),
-		ackChan:		make(chan ack, RECEIVE_BUFFER),
+		ackWaiters:         make(map[ackKey]chan error),
+		sendTimeout:        DefaultSendTimeout,
+		cookie:             newCookieState(),
+		handshakeLoadThreshold: defaultHandshakeLoadThreshold,
+		solicitLimiters:    make(map[string]*tokenBucket),
+		discoveryMode:      DiscoveryBroadcast,
+		beaconInterval:     defaultBeaconInterval,
+		beaconTTL:          defaultBeaconTTL,
+		transports:         map[string]Transport{defaultTransportScheme: tcpTransport{}},
 	}
 	n.setSequences[name] = 1
 	n.broadcastSequences[name] = 1
-	go n.connectionListener()
-	go n.broadcastListener()
-	go n.messageHandler()
-	go n.checkDegree()
-	return n, n.receive, n.errors
+	return n
+}
+
+// SetSendTimeout overrides the default timeout (DefaultSendTimeout) that Set
+// waits for each recipient's ack before reporting a timeout for it.
+func (n *Node) SetSendTimeout(d time.Duration) {
+	n.setLock.Lock()
+	defer n.setLock.Unlock()
+	n.sendTimeout = d
+}
+
+// replayMaxAdvance applies the per-source sliding-window replay filter in
+// filters to sequence id, bounding how far ahead of the current high-water
+// mark a single message may jump. The bound is only lifted when direct is
+// true: the Noise handshake only authenticates the immediate hop a message
+// arrived over, never the Message.Source or ID fields carried inside it, so
+// a relayed message -- or one whose immediate sender doesn't even claim to
+// be its own Source -- is exactly as forgeable as on the insecure transport,
+// regardless of n.insecure. Only a message an authenticated neighbor
+// delivered directly, about itself, is safe to trust without the bound; see
+// messageHandler.
+//
+// filters is keyed by (meshID, source), not source alone: a Link gives its
+// far-side membership its own meshID precisely so a source name on one side
+// of a bridge can never share a replay filter -- and therefore a sequence
+// number space -- with a same-named source on the other (see meshID).
+// Callers must hold n.sequenceLock.
+func (n *Node) replayMaxAdvance(filters map[string]*replayFilter, meshID, source string, id uint64, direct bool) bool {
+	f := replayFilterFor(filters, meshID, source)
+	if !n.insecure && direct {
+		return f.accept(id, 0)
+	}
+	return f.accept(id, maxSequenceAdvance)
+}
+
+// replayFilterKey joins meshID and source into the map key replayMaxAdvance
+// and purgeReplayFilters use, so filters never collide across meshes.
+func replayFilterKey(meshID, source string) string {
+	return meshID + "\x00" + source
+}
+
+// replayFilterFor returns the sliding-window replay filter for (meshID,
+// source) in filters, lazily creating it starting from high-water mark 0 if
+// this is the first message ever seen from that source on that mesh.
+func replayFilterFor(filters map[string]*replayFilter, meshID, source string) *replayFilter {
+	k := replayFilterKey(meshID, source)
+	f, ok := filters[k]
+	if !ok {
+		f = newReplayFilter(0)
+		filters[k] = f
+	}
+	return f
+}
+
+// purgeReplayFilters removes every replay filter in filters belonging to
+// source, regardless of meshID, when source drops out of the mesh entirely
+// (see intersect_locked).
+func purgeReplayFilters(filters map[string]*replayFilter, source string) {
+	suffix := "\x00" + source
+	for k := range filters {
+		if strings.HasSuffix(k, suffix) {
+			delete(filters, k)
+		}
+	}
+}
+
+// isTrusted reports whether pub is a known peer static key.
+func (n *Node) isTrusted(pub PublicKey) bool {
+	n.trustLock.Lock()
+	defer n.trustLock.Unlock()
+	return n.trusted[pub]
+}
+
+// isTrustedFingerprint reports whether fp -- a truncated SHA-256 fingerprint
+// as carried in a multicast beacon (see discovery.go) -- matches some
+// trusted peer's static public key. Unlike isTrusted, this only ever gives
+// multicastListen probable cause to dial; the Noise IK handshake the dial
+// triggers is what actually authenticates the peer.
+func (n *Node) isTrustedFingerprint(fp [8]byte) bool {
+	n.trustLock.Lock()
+	defer n.trustLock.Unlock()
+	for pub := range n.trusted {
+		sum := sha256.Sum256(pub[:])
+		if bytes.Equal(sum[:8], fp[:]) {
+			return true
+		}
+	}
+	return false
 }
 
 // check degree emits connection requests when our number of connected clients is below the degree threshold
@@ -131,6 +374,16 @@ func (n *Node) checkDegree() {
 	s := rand.NewSource(time.Now().UnixNano())
 	r := rand.New(s)
 	for uint(len(n.clients)) < n.degree {
+		n.discoveryLock.Lock()
+		mode := n.discoveryMode
+		n.discoveryLock.Unlock()
+		if mode != DiscoveryBroadcast {
+			// peer discovery is handled by multicast beacons (or is
+			// disabled entirely); nothing to broadcast
+			time.Sleep(time.Second)
+			continue
+		}
+
 		log.Debugln("soliciting connections")
 		b := net.IPv4(255, 255, 255, 255)
 		addr := net.UDPAddr{
@@ -172,7 +425,22 @@ func (n *Node) broadcastListener() {
 	}
 	for {
 		d := make([]byte, 1024)
-		read, _, err := ln.ReadFromUDP(d)
+		read, addr, err := ln.ReadFromUDP(d)
+		if err != nil {
+			log.Errorln(err)
+			n.errors <- err
+			continue
+		}
+		if !n.allowSolicit(addr.IP.String()) {
+			log.Debug("rate limiting solicitation from %v\n", addr.IP)
+			continue
+		}
+		n.discoveryLock.Lock()
+		mode := n.discoveryMode
+		n.discoveryLock.Unlock()
+		if mode == DiscoveryOff {
+			continue
+		}
 		data := strings.Split(string(d[:read]), ":")
 		if len(data) != 2 {
 			err = fmt.Errorf("gor malformed udp data: %v\n", data)
@@ -196,13 +464,32 @@ func (n *Node) broadcastListener() {
 	}
 }
 
-// connectionListener accepts incoming connections and hands new connections to a connection handler
+// connectionListener starts an accept loop for every Transport registered on
+// n (ordinarily just the default "tcp" transport, plus whatever WithTransport
+// options were passed to NewNode/NewNodeWithKeys), and hands each accepted
+// connection to a connection handler.
 func (n *Node) connectionListener() {
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", PORT))
-	if err != nil {
-		n.errors <- err
-		return
+	n.transportsLock.Lock()
+	transports := make(map[string]Transport, len(n.transports))
+	for scheme, t := range n.transports {
+		transports[scheme] = t
 	}
+	n.transportsLock.Unlock()
+
+	for scheme, t := range transports {
+		ln, err := t.Listen(fmt.Sprintf(":%d", PORT))
+		if err != nil {
+			n.errors <- err
+			continue
+		}
+		go n.acceptLoop(scheme, ln)
+	}
+}
+
+// acceptLoop accepts connections from ln, a single Transport's listener, for
+// as long as the node runs. An Accept error is reported on n.errors and the
+// loop carries on.
+func (n *Node) acceptLoop(scheme string, ln Listener) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -210,22 +497,46 @@ func (n *Node) connectionListener() {
 			n.errors <- err
 			continue
 		}
-		n.handleConnection(conn)
+		n.handleConnection(conn, n.insecure)
 	}
 }
 
 // handleConnection creates a new client and issues a handshake. It adds the client to the list
-// of clients only after a successful handshake
-func (n *Node) handleConnection(conn net.Conn) {
+// of clients only after a successful handshake. insecure is ordinarily just n.insecure, but a
+// Link passes true for its in-process net.Pipe to the bridge identity, which never needs (or
+// could complete) a Noise handshake: see link.go.
+func (n *Node) handleConnection(conn Conn, insecure bool) {
+	log.Debug("got conn: %v\n", conn.RemoteAddr())
+
+	var transport Conn = conn
+	var peerName string
+	if !insecure {
+		name, peerStatic, sendKey, recvKey, err := n.noiseIKResponder(conn)
+		if err != nil {
+			// handshake failed: close the connection without ever
+			// touching n.clients or any other mesh state
+			log.Errorln(err)
+			conn.Close()
+			return
+		}
+		sc, err := newSecureConn(conn, sendKey, recvKey)
+		if err != nil {
+			log.Errorln(err)
+			conn.Close()
+			return
+		}
+		log.Debug("authenticated peer static key: %x\n", peerStatic)
+		transport = sc
+		peerName = name
+	}
+
 	c := client{
-		conn: conn,
-		enc:  gob.NewEncoder(conn),
-		dec:  gob.NewDecoder(conn),
+		conn: transport,
+		enc:  gob.NewEncoder(transport),
+		dec:  gob.NewDecoder(transport),
 		hangup: make(chan bool),
 	}
 
-	log.Debug("got conn: %v\n", conn.RemoteAddr())
-
 	var command int
 	if uint(len(n.clients)) < n.degree {
 		command = HANDSHAKE_SOLICITED
@@ -261,12 +572,33 @@ func (n *Node) handleConnection(conn net.Conn) {
 		return
 	}
 
-	// valid connection, add it to the client roster
+	// the mesh-layer handshake is unauthenticated, so a trusted-but-malicious
+	// peer could otherwise claim any name here post-handshake; require it to
+	// match the name bound into the Noise transcript
+	clientName := hs.Source
+	if !insecure {
+		if hs.Source != peerName {
+			log.Errorln("meshage: mesh handshake source does not match authenticated peer identity")
+			conn.Close()
+			return
+		}
+		clientName = peerName
+	}
+
 	n.clientLock.Lock()
-	n.clients[hs.Source] = c
+	if _, ok := n.clients[clientName]; ok {
+		// already connected to you, no thanks.
+		n.clientLock.Unlock()
+		log.Errorln("already connected")
+		conn.Close()
+		return
+	}
+
+	// valid connection, add it to the client roster
+	n.clients[clientName] = c
 	n.clientLock.Unlock()
 
-	go n.receiveHandler(hs.Source)
+	go n.receiveHandler(clientName)
 }
 
 func (n *Node) receiveHandler(client string) {
@@ -296,7 +628,7 @@ receiveHandlerLoop:
 		select {
 		case m := <-messages:
 			log.Debug("receiveHandler got: %#v\n", m)
-			n.messagePump <- m
+			n.messagePump <- inboundMessage{Message: m, from: client}
 		case <-c.hangup:
 			log.Debugln("disconnecting from client")
 			break receiveHandlerLoop
@@ -360,32 +692,67 @@ func (n *Node) Hangup(client string) error {
 }
 
 func (n *Node) dial(host string, solicited bool) error {
-	addr := fmt.Sprintf("%s:%d", host, PORT)
+	return n.dialAddr(fmt.Sprintf("%s:%d", host, PORT), solicited)
+}
+
+// dialAddr is the guts of dial: it connects to an explicit host:port
+// address rather than assuming PORT, which multicast discovery needs since
+// a beacon carries the advertiser's actual listen address and port.
+func (n *Node) dialAddr(addr string, solicited bool) error {
 	log.Debug("Dialing: %v\n", addr)
-	conn, err := net.Dial("tcp", addr)
-	if err != nil {
-		log.Errorln(err)
-		return err
+
+	var conn Conn
+	var transport Conn
+	var peerName string
+	if n.insecure {
+		c, err := n.dialTransport(addr)
+		if err != nil {
+			log.Errorln(err)
+			return err
+		}
+		conn, transport = c, c
+	} else {
+		c, sc, name, err := n.dialSecureAddr(addr)
+		if err != nil {
+			log.Errorln(err)
+			return err
+		}
+		conn, transport = c, sc
+		peerName = name
 	}
-	enc := gob.NewEncoder(conn)
-	dec := gob.NewDecoder(conn)
+
+	enc := gob.NewEncoder(transport)
+	dec := gob.NewDecoder(transport)
 
 	var hs Message
-	err = dec.Decode(&hs)
+	err := dec.Decode(&hs)
 	if err != nil {
 		log.Errorln(err)
 		return err
 	}
 	log.Debug("Dial got: %v\n", hs)
 
+	// the mesh-layer handshake is unauthenticated, so a trusted-but-malicious
+	// peer could otherwise claim any name here post-handshake; require it to
+	// match the name bound into the Noise transcript
+	clientName := hs.Source
+	if !n.insecure {
+		if hs.Source != peerName {
+			conn.Close()
+			log.Errorln("meshage: mesh handshake source does not match authenticated peer identity")
+			return fmt.Errorf("meshage: mesh handshake source does not match authenticated peer identity")
+		}
+		clientName = peerName
+	}
+
 	// am i connecting to myself?
-	if hs.Source == n.name {
+	if clientName == n.name {
 		conn.Close()
 		log.Errorln("connecting to myself is not allowed")
 		return fmt.Errorf("connecting to myself is not allowed")
 	}
 
-	if _, ok := n.clients[hs.Source]; ok {
+	if _, ok := n.clients[clientName]; ok {
 		// we are already connected to you, no thanks.
 		conn.Close()
 		log.Errorln("already connected")
@@ -413,23 +780,23 @@ func (n *Node) dial(host string, solicited bool) error {
 
 	// add this client to our client list
 	c := client{
-		conn: conn,
+		conn: transport,
 		enc:  enc,
 		dec:  dec,
 		hangup: make(chan bool),
 	}
 
 	n.clientLock.Lock()
-	n.clients[hs.Source] = c
+	n.clients[clientName] = c
 	n.clientLock.Unlock()
-	go n.receiveHandler(hs.Source)
+	go n.receiveHandler(clientName)
 
 	// the network we're connecting to
 	mesh := hs.Body.(map[string][]string)
 
 	// add this new connection to the mesh and union with our mesh
-	mesh[n.name] = append(mesh[n.name], hs.Source)
-	mesh[hs.Source] = append(mesh[hs.Source], n.name)
+	mesh[n.name] = append(mesh[n.name], clientName)
+	mesh[clientName] = append(mesh[clientName], n.name)
 	n.union(mesh)
 
 	// let everyone know about the new topology
@@ -532,8 +899,8 @@ func (n *Node) intersect_locked(m map[string][]string) {
 			delete(n.mesh, k)
 			n.sequenceLock.Lock()
 			defer n.sequenceLock.Unlock()
-			delete(n.setSequences, k)
-			delete(n.broadcastSequences, k)
+			purgeReplayFilters(n.setReplay, k)
+			purgeReplayFilters(n.broadcastReplay, k)
 		}
 	}
 	log.Debug("new mesh is: %v\n", n.mesh)
@@ -556,14 +923,115 @@ func (n *Node) Send(m Message) {
 	}
 }
 
-// setSend sends a set type message according to known routes
+// deliverAck routes an incoming ack to whichever setSend call is still
+// waiting on it, identified by (a.Source, a.SetID, a.Recipient). If nothing
+// is waiting -- the call already timed out, or this is a stale duplicate --
+// the ack is simply dropped.
+func (n *Node) deliverAck(a ack) {
+	n.ackLock.Lock()
+	ch, ok := n.ackWaiters[ackKey{source: a.Source, setID: a.SetID, recipient: a.Recipient}]
+	n.ackLock.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case ch <- a.Err:
+	default:
+	}
+}
+
+// ackSet acknowledges a Set message m that this node was a recipient of,
+// routing a Command: ACK back to m.Source the same way any other Set
+// message travels. Like the forwarding relay in messageHandler, this is
+// fire-and-forget: Command: ACK messages are never themselves acked, so
+// there would be nothing to wait on.
+func (n *Node) ackSet(m Message) {
+	a := Message{
+		MessageType:  SET,
+		Recipients:   []string{m.Source},
+		Source:       n.name,
+		CurrentRoute: []string{n.name},
+		ID:           n.setID(),
+		Command:      ACK,
+		Body: ack{
+			Source:    m.Source,
+			SetID:     m.ID,
+			Recipient: n.name,
+			Err:       nil,
+		},
+		MeshID: n.meshID,
+	}
+	go n.setSend(a)
+}
+
+// updateRoute recomputes n.routes by a breadth-first search over n.mesh
+// rooted at this node, storing for every reachable node the first-hop
+// neighbor on a shortest path to it. It rebuilds the whole table rather than
+// just the entry for target, since nothing else invalidates stale routes
+// when the mesh changes (union/intersect update n.mesh but not n.routes) --
+// target is just what the caller happened to be missing.
+// Must be called with both meshLock and clientLock held, as setSend does.
+func (n *Node) updateRoute(target string) {
+	n.routes = make(map[string]string)
+	n.routes[n.name] = n.name
+
+	type hop struct {
+		node, via string
+	}
+	queue := []hop{{n.name, n.name}}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, neighbor := range n.mesh[cur.node] {
+			if _, seen := n.routes[neighbor]; seen {
+				continue
+			}
+			via := cur.via
+			if cur.node == n.name {
+				via = neighbor
+			}
+			n.routes[neighbor] = via
+			queue = append(queue, hop{neighbor, via})
+		}
+	}
+}
+
+// setSend sends a set type message according to known routes, then waits for
+// every recipient to ack (or nack, or time out). Acks are demuxed by
+// (m.Source, m.ID, recipient) rather than a single shared channel, so
+// concurrent calls to setSend -- whether from two goroutines calling Set at
+// once, or a Set call racing a relayed message at an intermediate hop --
+// never steal each other's acks. Every report to n.errors in here is
+// non-blocking: n.errors has no buffer, and a caller that isn't actively
+// draining it (most only read n.receive) would otherwise leave this call --
+// and, for the reports made while setLock/clientLock are held, every other
+// Set, checkDegree and client-list mutation too -- blocked forever.
 func (n *Node) setSend(m Message) error {
+	original_recipients := m.Recipients
+	waiters := make(map[string]chan error, len(original_recipients))
+
+	n.ackLock.Lock()
+	for _, v := range original_recipients {
+		ch := make(chan error, 1)
+		n.ackWaiters[ackKey{source: m.Source, setID: m.ID, recipient: v}] = ch
+		waiters[v] = ch
+	}
+	n.ackLock.Unlock()
+
+	defer func() {
+		n.ackLock.Lock()
+		for _, v := range original_recipients {
+			delete(n.ackWaiters, ackKey{source: m.Source, setID: m.ID, recipient: v})
+		}
+		n.ackLock.Unlock()
+	}()
+
 	n.setLock.Lock()
-	defer n.setLock.Unlock()
+	// meshLock before clientLock, matching union's lock order, since
+	// updateRoute below reads n.mesh while this holds n.clients.
+	n.meshLock.Lock()
 	n.clientLock.Lock()
 
-	original_recipients := m.Recipients
-
 	// we want to duplicate the message for each slice of recipients that follow a like route from this node
 	route_slices := make(map[string][]string)
 
@@ -578,13 +1046,11 @@ func (n *Node) setSend(m Message) error {
 			if route, ok = n.routes[v]; !ok {
 				err := fmt.Errorf("no route to host: %v", v)
 				log.Errorln(err)
-				n.errors <- err
-				go func(v string, err error) {
-					n.ackChan <-ack{
-						Recipient: v,
-						Err: err,
-					}
-				}(v,err)
+				select {
+				case n.errors <- err:
+				default:
+				}
+				waiters[v] <- err
 				continue
 			}
 		}
@@ -592,33 +1058,52 @@ func (n *Node) setSend(m Message) error {
 	}
 
 	for k, v := range route_slices {
-		m.Recipients = v
+		mm := m
+		mm.Recipients = v
 		// get the client for this route
 		if c, ok := n.clients[k]; ok {
-			go n.sendOne(c, m)
+			go n.sendOne(c, mm)
 		} else {
 			err := fmt.Errorf("mismatched client list and topology, something is very wrong: %v, %#v", v, n.clients)
 			log.Errorln(err)
-			n.errors <- err
+			select {
+			case n.errors <- err:
+			default:
+			}
+			for _, recipient := range v {
+				waiters[recipient] <- err
+			}
 		}
 	}
+	timeout := n.sendTimeout
 	n.clientLock.Unlock()
-
-	// wait on ack/nacks from evreyone
-	// TODO: add timeout to this, lest we wait forever!
-	var ret error
-	for i:=0; i<len(original_recipients); i++ {
-		a := <-n.ackChan
-		if a.Err != nil {
-			n.errors <- a.Err
-			if ret == nil {
-				ret = fmt.Errorf("failed to send to: %v", a.Recipient)
-			} else {
-				ret = fmt.Errorf("%v, %v", ret, a.Recipient)
+	n.meshLock.Unlock()
+	n.setLock.Unlock()
+
+	// deadline, not timeout, bounds this loop: without it each iteration
+	// would start its own fresh timeout-length wait, so N unresponsive
+	// recipients would cost N*timeout instead of the single bounded wait
+	// sendTimeout promises callers.
+	deadline := time.Now().Add(timeout)
+	failed := make(map[string]error)
+	for _, v := range original_recipients {
+		select {
+		case err := <-waiters[v]:
+			if err != nil {
+				select {
+				case n.errors <- err:
+				default:
+				}
+				failed[v] = err
 			}
+		case <-time.After(time.Until(deadline)):
+			failed[v] = fmt.Errorf("timed out waiting for ack from %v after %v", v, timeout)
 		}
 	}
-	return ret
+	if len(failed) > 0 {
+		return &SetError{Failed: failed}
+	}
+	return nil
 }
 
 // broadcastSend sends a broadcast message to all connected clients
@@ -645,8 +1130,10 @@ func (n *Node) Heartbeat() error {
 	return nil
 }
 
-// Set sends a set message to a list of recipients. Set blocks until all 
-// recipients have acknowledged the message, or returns a non-nil error.
+// Set sends a set message to a list of recipients. Set blocks until all
+// recipients have acknowledged the message, every recipient's ack has timed
+// out (see SetSendTimeout), or all routes fail. Any failures are reported
+// together as a *SetError, keyed by recipient.
 func (n *Node) Set(recipients []string, body interface{}) error {
 	u := Message{
 		MessageType: SET,
@@ -656,6 +1143,7 @@ func (n *Node) Set(recipients []string, body interface{}) error {
 		ID: n.setID(),
 		Command: MESSAGE,
 		Body: body,
+		MeshID: n.meshID,
 	}
 	log.Debug("set send message %#v\n", u)
 	return n.setSend(u)
@@ -671,6 +1159,7 @@ func (n *Node) Broadcast(body interface{}) {
 		ID:           n.broadcastID(),
 		Command:      MESSAGE,
 		Body:         body,
+		MeshID:       n.meshID,
 	}
 	log.Debug("broadcasting message %#v\n", u)
 	n.broadcastSend(u)
@@ -698,19 +1187,33 @@ func (n *Node) setID() uint64 {
 
 // messageHandler receives messages on a channel from any clients and processes them.
 // Some messages are rebroadcast, or sent along other routes. Messages intended for this
-// node are sent along the receive channel to the user.
+// node are sent along the receive channel to the user. Message.MeshID, if set, scopes
+// m.Source to the bridge that originated it, so replayMaxAdvance never shares a replay
+// filter -- or its sequence number space -- between a same-named source on either side
+// of a Link (see replayFilterFor).
 func (n *Node) messageHandler() {
 	for {
-		m := <-n.messagePump
+		im := <-n.messagePump
+		m := im.Message
 		log.Debug("messageHandler: %#v\n", m)
+
+		// direct is true only when the immediate, authenticated neighbor
+		// that handed us m is itself m.Source, and m hasn't already
+		// passed through anyone else -- the one case where the Noise
+		// handshake on this hop actually vouches for the claim. See
+		// replayMaxAdvance.
+		direct := im.from == m.Source && len(m.CurrentRoute) == 1 && m.CurrentRoute[0] == m.Source
+
 		switch m.MessageType {
 		case SET:
-			// should we handle this or drop it?
-			if n.setSequences[m.Source] < m.ID {
-				// it's a new message to us
-				n.sequenceLock.Lock()
-				n.setSequences[m.Source] = m.ID
-				n.sequenceLock.Unlock()
+			// should we handle this or drop it? accept checks both
+			// that m.ID hasn't been seen before and that it isn't
+			// an implausible jump ahead of the window, unless m
+			// arrived directly from an authenticated source.
+			n.sequenceLock.Lock()
+			accepted := n.replayMaxAdvance(n.setReplay, m.MeshID, m.Source, m.ID, direct)
+			n.sequenceLock.Unlock()
+			if accepted {
 				m.CurrentRoute = append(m.CurrentRoute, n.name)
 
 				// do we also handle it?
@@ -728,11 +1231,10 @@ func (n *Node) messageHandler() {
 			}
 		case BROADCAST:
 			// should we handle this or drop it?
-			if n.broadcastSequences[m.Source] < m.ID {
-				// it's a new message to us
-				n.sequenceLock.Lock()
-				n.broadcastSequences[m.Source] = m.ID
-				n.sequenceLock.Unlock()
+			n.sequenceLock.Lock()
+			accepted := n.replayMaxAdvance(n.broadcastReplay, m.MeshID, m.Source, m.ID, direct)
+			n.sequenceLock.Unlock()
+			if accepted {
 				// update the route information
 				m.CurrentRoute = append(m.CurrentRoute, n.name)
 				go n.broadcastSend(m)
@@ -754,8 +1256,11 @@ func (n *Node) handleMessage(m Message) {
 		n.intersect(m.Body.(map[string][]string))
 	case MESSAGE:
 		n.receive <- m
+		if m.MessageType == SET {
+			n.ackSet(m)
+		}
 	case ACK:
-		n.ackChan <- m.Body.(ack)
+		n.deliverAck(m.Body.(ack))
 	default:
 		err := fmt.Errorf("handleMessage: invalid message type")
 		log.Errorln(err)
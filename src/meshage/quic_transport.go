@@ -0,0 +1,195 @@
+package meshage
+
+// quicTransport is a Transport built on QUIC (github.com/quic-go/quic-go)
+// instead of a raw TCP socket. Each meshage Conn it hands out is a single
+// QUIC stream on its own UDP-based QUIC connection, which gives meshage
+// NAT-friendlier keepalive from the transport itself. All messages to a
+// peer share that one stream; the transport adds no per-message framing,
+// so gob's Encoder/Decoder frame messages over it as they do over TCP.
+//
+// Authentication rides on QUIC's mandatory TLS 1.3 rather than meshage's own
+// Noise handshake: NewQUICTransport generates a self-signed certificate that
+// embeds the node's Noise static public key (see crypto.go) as a custom
+// extension, and VerifyPeerCertificate cross-checks the peer's embedded key
+// against the same trusted set n.trusted already uses for TCP peers. A node
+// dialing or accepting only over this transport can therefore be built with
+// NewNode, which sets n.insecure, and skip the Noise handshake entirely, since
+// QUIC has already authenticated and encrypted the connection; a node that
+// mixes this transport with plain TCP should keep n.insecure false so TCP
+// peers still get Noise.
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// staticKeySANOID tags the certificate extension that carries a node's Noise
+// static public key. The arc is otherwise unused and unregistered; nothing
+// outside this file interprets the OID itself.
+var staticKeySANOID = []int{1, 3, 6, 1, 4, 1, 57341, 1}
+
+// quicTransport implements Transport over QUIC.
+type quicTransport struct {
+	tlsConf *tls.Config
+	qConf   *quic.Config
+}
+
+// NewQUICTransport builds a Transport that authenticates peers by Noise
+// static public key, embedded in a self-signed certificate, rather than by a
+// certificate authority. static is this node's own key, presented to peers;
+// trusted is the set of peer keys willing to be dialed or accepted -- the
+// same set passed to NewNodeWithKeys.
+func NewQUICTransport(static PrivateKey, trusted []PublicKey) (Transport, error) {
+	cert, err := selfSignedCert(static)
+	if err != nil {
+		return nil, err
+	}
+
+	trustedSet := make(map[PublicKey]bool, len(trusted))
+	for _, k := range trusted {
+		trustedSet[k] = true
+	}
+
+	tlsConf := &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,                     // we verify the embedded static key ourselves, not the chain
+		ClientAuth:         tls.RequireAnyClientCert, // without this the server never asks a dialing peer for a cert, so VerifyPeerCertificate never runs on accept
+		NextProtos:         []string{"meshage"},
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("meshage: peer presented no certificate")
+			}
+			peerCert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			peerStatic, err := staticKeyFromCert(peerCert)
+			if err != nil {
+				return err
+			}
+			if !trustedSet[peerStatic] {
+				return errors.New("meshage: peer static key is not trusted")
+			}
+			return nil
+		},
+	}
+
+	return quicTransport{tlsConf: tlsConf, qConf: &quic.Config{KeepAlivePeriod: 15 * time.Second}}, nil
+}
+
+func (t quicTransport) Listen(addr string) (Listener, error) {
+	ln, err := quic.ListenAddr(addr, t.tlsConf, t.qConf)
+	if err != nil {
+		return nil, err
+	}
+	return quicListener{ln}, nil
+}
+
+func (t quicTransport) Dial(addr string) (Conn, error) {
+	conn, err := quic.DialAddr(context.Background(), addr, t.tlsConf, t.qConf)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(context.Background())
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, err
+	}
+	return quicConn{conn: conn, stream: stream}, nil
+}
+
+type quicListener struct {
+	ln *quic.Listener
+}
+
+func (l quicListener) Accept() (Conn, error) {
+	conn, err := l.ln.Accept(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.AcceptStream(context.Background())
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, err
+	}
+	return quicConn{conn: conn, stream: stream}, nil
+}
+
+func (l quicListener) Close() error {
+	return l.ln.Close()
+}
+
+// quicConn adapts a single QUIC stream (plus the connection it rides on) to
+// Conn. meshage sees one stream per peer, which is all it ever asks a
+// Transport for; multiple streams per connection are QUIC's business, not
+// meshage's.
+type quicConn struct {
+	conn   quic.Connection
+	stream quic.Stream
+}
+
+func (c quicConn) Read(p []byte) (int, error)  { return c.stream.Read(p) }
+func (c quicConn) Write(p []byte) (int, error) { return c.stream.Write(p) }
+func (c quicConn) Close() error {
+	c.stream.Close()
+	return c.conn.CloseWithError(0, "")
+}
+func (c quicConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// selfSignedCert generates a self-signed TLS certificate whose only purpose
+// is to carry static's public key to the peer for VerifyPeerCertificate to
+// check; the certificate's own keypair and validity period are otherwise
+// meaningless; since both sides verify the embedded static key out of band,
+// a random identity keypair and a long validity window are sufficient.
+func selfSignedCert(static PrivateKey) (tls.Certificate, error) {
+	pub := static.PublicKey()
+
+	certPub, certPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "meshage"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		ExtraExtensions: []pkix.Extension{
+			{Id: staticKeySANOID, Value: pub[:]},
+		},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, certPub, certPriv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: certPriv}, nil
+}
+
+// staticKeyFromCert extracts the Noise static public key selfSignedCert
+// embedded in cert.
+func staticKeyFromCert(cert *x509.Certificate) (PublicKey, error) {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(staticKeySANOID) {
+			continue
+		}
+		if len(ext.Value) != keySize {
+			return PublicKey{}, errors.New("meshage: malformed static key extension")
+		}
+		var pub PublicKey
+		copy(pub[:], ext.Value)
+		return pub, nil
+	}
+	return PublicKey{}, errors.New("meshage: certificate carries no static key extension")
+}
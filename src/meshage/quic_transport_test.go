@@ -0,0 +1,84 @@
+package meshage
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// TestQUICListenerRejectsUnauthenticatedDial demonstrates the bug chunk0-7
+// was filed to close: without ClientAuth: tls.RequireAnyClientCert, the QUIC
+// server never asks a dialing peer for a certificate at all, so
+// VerifyPeerCertificate never runs on accept and any unauthenticated client
+// is accepted as a fully trusted peer.
+//
+// quic.DialAddr's returned error is not a reliable signal here: TLS 1.3's
+// 0.5-RTT handshake confirmation lets the client-side dial report success
+// before the server's CRYPTO_ERROR "certificate required" rejection is
+// observable, even though the server never completes Accept for the
+// connection. So instead of failing fast on dialErr == nil, drive an actual
+// stream: opening it, or the write/read on it, must surface the rejection.
+func TestQUICListenerRejectsUnauthenticatedDial(t *testing.T) {
+	_, trustedPub, err := GenerateKeypair()
+	if err != nil {
+		t.Fatalf("GenerateKeypair: %v", err)
+	}
+	serverPriv, _, err := GenerateKeypair()
+	if err != nil {
+		t.Fatalf("GenerateKeypair: %v", err)
+	}
+
+	transport, err := NewQUICTransport(serverPriv, []PublicKey{trustedPub})
+	if err != nil {
+		t.Fatalf("NewQUICTransport: %v", err)
+	}
+
+	ln, err := transport.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+	addr := ln.(quicListener).ln.Addr().String()
+
+	acceptDone := make(chan error, 1)
+	go func() {
+		_, err := ln.Accept()
+		acceptDone <- err
+	}()
+
+	// A client presenting no certificate at all -- not even an untrusted
+	// one -- is the simplest possible unauthenticated dial.
+	clientConf := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"meshage"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, dialErr := quic.DialAddr(ctx, addr, clientConf, nil)
+	if dialErr == nil {
+		streamCtx, streamCancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer streamCancel()
+		stream, streamErr := conn.OpenStreamSync(streamCtx)
+		if streamErr == nil {
+			_, streamErr = stream.Write([]byte("hello"))
+		}
+		if streamErr == nil {
+			buf := make([]byte, 1)
+			_, streamErr = stream.Read(buf)
+		}
+		if streamErr == nil {
+			t.Fatal("stream write/read succeeded on an unauthenticated dial; server is not requesting client certs")
+		}
+	}
+
+	select {
+	case err := <-acceptDone:
+		if err == nil {
+			t.Fatal("Accept returned a connection for an unauthenticated dial")
+		}
+	case <-time.After(2 * time.Second):
+		// The server detects the missing certificate deep enough into the
+		// handshake that Accept simply never completes for this
+		// connection -- the expected, secure outcome, not a failure.
+	}
+}
@@ -0,0 +1,77 @@
+package meshage
+
+// replayWindowSize is the number of past sequence IDs tracked behind the
+// highest one seen, modeled on WireGuard's anti-replay window.
+const replayWindowSize = 2048
+
+// maxSequenceAdvance bounds how far ahead of the current high-water mark a
+// single message may jump the window in one step. Without this, a single
+// forged high ID (e.g. near math.MaxUint64) would shift the whole window
+// past every legitimate future ID from that source, silencing it for good.
+const maxSequenceAdvance = RECEIVE_BUFFER * 8
+
+// replayFilter is a sliding-window replay filter for a single message
+// source: it remembers the highest sequence ID accepted so far plus a
+// bitmap of which of the replayWindowSize IDs immediately behind it have
+// already been seen.
+type replayFilter struct {
+	high   uint64
+	bitmap [replayWindowSize / 64]uint64
+}
+
+// newReplayFilter returns a filter initialized so the first ID accepted is
+// treated as advancing the window from high.
+func newReplayFilter(high uint64) *replayFilter {
+	return &replayFilter{high: high}
+}
+
+func (f *replayFilter) bit(n uint64) (word uint64, mask uint64) {
+	offset := n % replayWindowSize
+	return offset / 64, 1 << (offset % 64)
+}
+
+// accept reports whether sequence id n is new (not previously seen and not
+// too far ahead to trust), marking it as seen as a side effect. A maxAdvance
+// of 0 disables the jump bound; authenticated callers (messages that arrived
+// over the encrypted transport) pass 0 since a forged jump there would
+// require breaking the AEAD, not just guessing a number.
+func (f *replayFilter) accept(n uint64, maxAdvance uint64) bool {
+	if n == 0 {
+		return false
+	}
+
+	if n > f.high {
+		if maxAdvance > 0 && n > f.high+maxAdvance {
+			return false
+		}
+
+		// advance the window, clearing bits for IDs that just fell
+		// out the back of it
+		advance := n - f.high
+		if advance > replayWindowSize {
+			f.bitmap = [replayWindowSize / 64]uint64{}
+		} else {
+			for i := f.high + 1; i <= f.high+advance && i <= f.high+replayWindowSize; i++ {
+				w, m := f.bit(i)
+				f.bitmap[w] &^= m
+			}
+		}
+		f.high = n
+		w, m := f.bit(n)
+		f.bitmap[w] |= m
+		return true
+	}
+
+	if f.high-n >= replayWindowSize {
+		// too old, outside the window entirely
+		return false
+	}
+
+	w, m := f.bit(n)
+	if f.bitmap[w]&m != 0 {
+		// already seen
+		return false
+	}
+	f.bitmap[w] |= m
+	return true
+}
@@ -0,0 +1,113 @@
+package meshage
+
+// This file defines the Transport abstraction that handleConnection, dial
+// and client are built on, so meshage's wire protocol (gob framing, the
+// Noise handshake, replay protection) stays independent of exactly how
+// bytes reach a peer. tcpTransport below is the original TCP+gob transport;
+// quic_transport.go supplies a second, QUIC-based one. A Node can register
+// more than one at once (see WithTransport), which is how a bridge accepts
+// legacy TCP peers while dialing new ones over QUIC.
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// defaultTransportScheme is the scheme a bare "host:port" dial address (no
+// "scheme://" prefix) resolves to. It is always "tcp", so every existing
+// caller and every address meshage has ever accepted keeps working
+// unchanged.
+const defaultTransportScheme = "tcp"
+
+// Transport abstracts how a Node listens for and dials peer connections.
+// Listen and Dial both take a bare "host:port", never a scheme -- the
+// scheme only exists in dial addresses passed to Dial/Peer, to pick which
+// registered Transport handles them.
+type Transport interface {
+	Listen(addr string) (Listener, error)
+	Dial(addr string) (Conn, error)
+}
+
+// Listener hands off connections a Transport has accepted.
+type Listener interface {
+	Accept() (Conn, error)
+	Close() error
+}
+
+// Conn is the full-duplex byte stream meshage needs from a transport: enough
+// of net.Conn for gob's Encoder/Decoder, and the Noise handshake (see
+// crypto.go), to read and write through directly. Every net.Conn already
+// satisfies it. A Conn carries no message framing of its own; gob supplies
+// it.
+type Conn interface {
+	io.ReadWriteCloser
+	RemoteAddr() net.Addr
+}
+
+// splitScheme splits a dial address of the form "scheme://host:port" into
+// its scheme and the bare "host:port". An address with no "://" has no
+// scheme and resolves to defaultTransportScheme.
+func splitScheme(addr string) (scheme, rest string) {
+	if i := strings.Index(addr, "://"); i >= 0 {
+		return addr[:i], addr[i+len("://"):]
+	}
+	return defaultTransportScheme, addr
+}
+
+// dialTransport resolves addr's scheme to a registered Transport and dials
+// the bare host:port underneath it.
+func (n *Node) dialTransport(addr string) (Conn, error) {
+	scheme, rest := splitScheme(addr)
+
+	n.transportsLock.Lock()
+	t, ok := n.transports[scheme]
+	n.transportsLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("meshage: no transport registered for scheme %q", scheme)
+	}
+	return t.Dial(rest)
+}
+
+// NodeOption configures optional behavior when constructing a Node; see
+// WithTransport.
+type NodeOption func(*Node)
+
+// WithTransport registers t as the Transport used for dial addresses of the
+// form "scheme://host:port", and gives it its own accept loop alongside any
+// other registered transport. Registering a Transport under "tcp" replaces
+// meshage's default TCP+gob transport.
+func WithTransport(scheme string, t Transport) NodeOption {
+	return func(n *Node) {
+		n.transports[scheme] = t
+	}
+}
+
+// tcpTransport is meshage's original transport: a plain TCP socket, framed
+// by gob.Encoder/Decoder directly over the connection.
+type tcpTransport struct{}
+
+func (tcpTransport) Listen(addr string) (Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return tcpListener{ln}, nil
+}
+
+func (tcpTransport) Dial(addr string) (Conn, error) {
+	return net.Dial("tcp", addr)
+}
+
+type tcpListener struct {
+	ln net.Listener
+}
+
+func (l tcpListener) Accept() (Conn, error) {
+	return l.ln.Accept()
+}
+
+func (l tcpListener) Close() error {
+	return l.ln.Close()
+}